@@ -0,0 +1,217 @@
+package libproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// bufferedPipeChunk is one buffer queued for a reader, by Write or
+// WriteBuffer, along with how much of it has already been consumed and,
+// for a WriteBuffer chunk, how to return the buffer to wherever it came
+// from (e.g. payloadBufferPool) once it's fully drained.
+type bufferedPipeChunk struct {
+	buf     []byte
+	off     int
+	release func()
+}
+
+// bufferedPipe is the single-reader byte stream a channel's readPipe is
+// built from: multiplexer.run feeds DataFrame payloads in via Write or, for
+// the zero-copy path, WriteBuffer, and channel.Read/ReadBuffers drain them
+// out, blocking when empty until more arrives or the write side is closed.
+// Write/WriteBuffer in turn block once capacity unread bytes are queued,
+// applying backpressure to a slow reader instead of buffering it unbounded -
+// this is what makes writeToChannel's ReceiveTimeout able to fire at all.
+type bufferedPipe struct {
+	m            sync.Mutex
+	c            *sync.Cond
+	chunks       []bufferedPipeChunk
+	buffered     int
+	capacity     int
+	writeClosed  bool
+	writeErr     error
+	readDeadline time.Time
+}
+
+func newBufferedPipe(capacity int) *bufferedPipe {
+	p := &bufferedPipe{capacity: capacity}
+	p.c = sync.NewCond(&p.m)
+	return p
+}
+
+// SetReadDeadline makes any pending or future Read return an error once t
+// has passed. A zero Time disables the deadline.
+func (p *bufferedPipe) SetReadDeadline(t time.Time) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.readDeadline = t
+	p.c.Broadcast()
+	return nil
+}
+
+// Write copies p into the pipe for Read to drain. It blocks while capacity
+// unread bytes are already queued, to apply backpressure to a writer faster
+// than the reader rather than buffering it unbounded. Returns
+// io.ErrClosedPipe if the write side was already closed, or is closed while
+// waiting for space.
+func (p *bufferedPipe) Write(b []byte) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if err := p.waitForSpace(len(b)); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	p.chunks = append(p.chunks, bufferedPipeChunk{buf: buf})
+	p.buffered += len(buf)
+	p.c.Broadcast()
+	return len(b), nil
+}
+
+// waitForSpace blocks, with p.m already held, until there's room to queue n
+// more bytes without exceeding capacity. A single write larger than
+// capacity is still let through once nothing else is queued, rather than
+// deadlocking forever. capacity <= 0 disables the bound entirely.
+func (p *bufferedPipe) waitForSpace(n int) error {
+	for p.capacity > 0 && p.buffered > 0 && p.buffered+n > p.capacity && !p.writeClosed {
+		p.c.Wait()
+	}
+	if p.writeClosed {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+func (p *bufferedPipe) Read(b []byte) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.readLocked(b)
+}
+
+// WriteBuffer hands buf to the reader without copying it, unlike Write:
+// readLocked copies bytes back out of it as the reader drains it, and
+// calls release once it's fully consumed, e.g. to return buf to
+// payloadBufferPool. Like Write, it blocks while capacity unread bytes are
+// already queued. Returns io.ErrClosedPipe, calling release immediately, if
+// the write side was already closed (a peer sending data after
+// Shutdown/Close/Reset) or is closed while waiting for space.
+func (p *bufferedPipe) WriteBuffer(buf []byte, release func()) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if err := p.waitForSpace(len(buf)); err != nil {
+		if release != nil {
+			release()
+		}
+		return err
+	}
+	p.chunks = append(p.chunks, bufferedPipeChunk{buf: buf, release: release})
+	p.buffered += len(buf)
+	p.c.Broadcast()
+	return nil
+}
+
+// ReadBuffers fills bufs in order, the same way Read fills a single slice,
+// stopping as soon as one segment comes back short (EOF, a reset, or a
+// closed write side) rather than blocking for the rest.
+func (p *bufferedPipe) ReadBuffers(bufs net.Buffers) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	total := 0
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		n, err := p.readLocked(b)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < len(b) {
+			break
+		}
+	}
+	return total, nil
+}
+
+// readLocked does the work of Read with p.m already held, so ReadBuffers
+// can drain several buffers under a single lock acquisition.
+func (p *bufferedPipe) readLocked(b []byte) (int, error) {
+	for {
+		if len(p.chunks) > 0 {
+			chunk := &p.chunks[0]
+			n := copy(b, chunk.buf[chunk.off:])
+			chunk.off += n
+			p.buffered -= n
+			if chunk.off >= len(chunk.buf) {
+				if chunk.release != nil {
+					chunk.release()
+				}
+				p.chunks = p.chunks[1:]
+			}
+			// Wake any Write/WriteBuffer blocked in waitForSpace now that
+			// there's room for more.
+			p.c.Broadcast()
+			return n, nil
+		}
+		if p.writeClosed {
+			if p.writeErr != nil {
+				return 0, p.writeErr
+			}
+			return 0, io.EOF
+		}
+
+		var (
+			timer    *time.Timer
+			timedOut bool
+		)
+		if !p.readDeadline.IsZero() {
+			timer = time.AfterFunc(time.Until(p.readDeadline), func() {
+				p.m.Lock()
+				defer p.m.Unlock()
+				timedOut = true
+				p.c.Broadcast()
+			})
+		}
+		p.c.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		if timedOut {
+			return 0, &errTimeout{}
+		}
+	}
+}
+
+// closeWrite closes the write side of the pipe, causing Read to drain
+// whatever's left and then return err (or io.EOF if err is nil).
+func (p *bufferedPipe) closeWrite(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.writeClosed {
+		return
+	}
+	p.writeClosed = true
+	p.writeErr = err
+	p.c.Broadcast()
+}
+
+// CloseWrite closes the write side gracefully: Read drains any buffered
+// chunks and then returns io.EOF.
+func (p *bufferedPipe) CloseWrite() error {
+	p.closeWrite(nil)
+	return nil
+}
+
+// closeWriteNoErr is CloseWrite without the error return, for call sites
+// that can't fail (e.g. multiplexer.run and teardown unblocking Read calls).
+func (p *bufferedPipe) closeWriteNoErr() {
+	p.closeWrite(nil)
+}
+
+// closeWriteError closes the write side the way Reset does: Read drains any
+// buffered chunks and then returns err instead of io.EOF.
+func (p *bufferedPipe) closeWriteError(err error) {
+	p.closeWrite(err)
+}
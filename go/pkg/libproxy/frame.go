@@ -0,0 +1,329 @@
+package libproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frameType identifies which kind of command a Frame carries, and so which
+// concrete type its Payload() holds.
+type frameType uint8
+
+const (
+	frameTypeOpen frameType = iota
+	frameTypeClose
+	frameTypeShutdown
+	frameTypeData
+	frameTypeWindow
+	frameTypePing
+	frameTypePong
+	frameTypeReset
+	frameTypeResume
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameTypeOpen:
+		return "Open"
+	case frameTypeClose:
+		return "Close"
+	case frameTypeShutdown:
+		return "Shutdown"
+	case frameTypeData:
+		return "Data"
+	case frameTypeWindow:
+		return "Window"
+	case frameTypePing:
+		return "Ping"
+	case frameTypePong:
+		return "Pong"
+	case frameTypeReset:
+		return "Reset"
+	case frameTypeResume:
+		return "Resume"
+	default:
+		return fmt.Sprintf("frameType(%d)", uint8(t))
+	}
+}
+
+// Frame is the header every message on the wire starts with: ID says which
+// channel it's for (meaningless for PingFrame/PongFrame, which aren't
+// addressed to any one channel - ID is left 0), and payload holds the
+// decoded command-specific fields, one of the *...Frame types below
+// depending on kind.
+type Frame struct {
+	ID      uint32
+	kind    frameType
+	payload interface{}
+}
+
+func (f *Frame) String() string {
+	return fmt.Sprintf("%s frame, channel %d: %v", f.kind, f.ID, f.payload)
+}
+
+// Payload returns f's decoded command-specific fields so callers can type
+// switch on it, e.g. *OpenFrame, *DataFrame, *PingFrame.
+func (f *Frame) Payload() interface{} {
+	return f.payload
+}
+
+// Open returns f's payload as an *OpenFrame, failing if f isn't one.
+func (f *Frame) Open() (*OpenFrame, error) {
+	o, ok := f.payload.(*OpenFrame)
+	if !ok {
+		return nil, fmt.Errorf("expected an Open frame, got %s", f)
+	}
+	return o, nil
+}
+
+// OpenFrame asks the peer to create a new channel with the given ID,
+// connected to Destination.
+type OpenFrame struct {
+	Connection  ConnectionType
+	Destination Destination
+}
+
+func (o *OpenFrame) String() string {
+	return fmt.Sprintf("Open %s -> %s", o.Connection, o.Destination)
+}
+
+// CloseFrame tells the peer this side is done with the channel entirely:
+// both directions are finished and its ID may be reused once acknowledged.
+type CloseFrame struct{}
+
+func (*CloseFrame) String() string { return "Close" }
+
+// ShutdownFrame tells the peer this side won't send any more data on the
+// channel, analogous to net.Conn's CloseWrite - the channel itself stays
+// open until a CloseFrame follows.
+type ShutdownFrame struct{}
+
+func (*ShutdownFrame) String() string { return "Shutdown" }
+
+// DataFrame precedes payloadlen bytes of channel payload, read separately
+// by multiplexer.run rather than carried inline on the Frame itself.
+type DataFrame struct {
+	payloadlen uint32
+}
+
+func (d *DataFrame) String() string { return fmt.Sprintf("Data %d bytes", d.payloadlen) }
+
+// WindowFrame grants the peer permission to send up to seq bytes total on
+// the channel, extending its write window.
+type WindowFrame struct {
+	seq uint64
+}
+
+func (w *WindowFrame) String() string { return fmt.Sprintf("Window %d", w.seq) }
+
+// PingFrame is a connection-level keepalive probe carrying a token that the
+// matching PongFrame echoes back, so the sender can tell which ping it
+// acknowledges.
+type PingFrame struct {
+	token uint32
+}
+
+func (p *PingFrame) String() string { return fmt.Sprintf("Ping %d", p.token) }
+
+// PongFrame acknowledges a PingFrame carrying the same token.
+type PongFrame struct {
+	token uint32
+}
+
+func (p *PongFrame) String() string { return fmt.Sprintf("Pong %d", p.token) }
+
+// ResetFrame forcefully aborts a channel, carrying one of the ResetCode*
+// constants as code so the peer can tell why (a normal cancellation vs. an
+// eviction for being too slow to drain, say).
+type ResetFrame struct {
+	code uint32
+}
+
+func (r *ResetFrame) String() string { return fmt.Sprintf("Reset code %d", r.code) }
+
+// ResumeFrame is sent by a ReconnectingMultiplexer after redialing, telling
+// the peer where this side currently stands for a channel that survived the
+// reconnect: readSeq is how many bytes this side has received (so the peer
+// can tell what it sent that never arrived and needs replaying), and
+// writeSeq is how many bytes this side has sent, which the peer checks
+// against how many it has received (see channel.recvResume).
+type ResumeFrame struct {
+	readSeq, writeSeq uint64
+}
+
+func (r *ResumeFrame) String() string {
+	return fmt.Sprintf("Resume readSeq %d writeSeq %d", r.readSeq, r.writeSeq)
+}
+
+// NewOpen builds an Open frame asking the peer to create channel id,
+// connected to d.
+func NewOpen(id uint32, d Destination) *Frame {
+	return &Frame{ID: id, kind: frameTypeOpen, payload: &OpenFrame{Connection: Multiplexed, Destination: d}}
+}
+
+// NewClose builds a Close frame for channel id.
+func NewClose(id uint32) *Frame {
+	return &Frame{ID: id, kind: frameTypeClose, payload: &CloseFrame{}}
+}
+
+// NewShutdown builds a Shutdown frame for channel id.
+func NewShutdown(id uint32) *Frame {
+	return &Frame{ID: id, kind: frameTypeShutdown, payload: &ShutdownFrame{}}
+}
+
+// NewData builds a Data frame announcing length bytes of payload to follow
+// on channel id. The payload itself is written separately by send.
+func NewData(id uint32, length uint32) *Frame {
+	return &Frame{ID: id, kind: frameTypeData, payload: &DataFrame{payloadlen: length}}
+}
+
+// NewWindow builds a Window frame granting channel id a write window up to
+// seq.
+func NewWindow(id uint32, seq uint64) *Frame {
+	return &Frame{ID: id, kind: frameTypeWindow, payload: &WindowFrame{seq: seq}}
+}
+
+// NewReset builds a Reset frame aborting channel id with the given code.
+func NewReset(id uint32, code uint32) *Frame {
+	return &Frame{ID: id, kind: frameTypeReset, payload: &ResetFrame{code: code}}
+}
+
+// NewResume builds a Resume frame for channel id, reporting readSeq bytes
+// received and writeSeq bytes sent so far on it.
+func NewResume(id uint32, readSeq, writeSeq uint64) *Frame {
+	return &Frame{ID: id, kind: frameTypeResume, payload: &ResumeFrame{readSeq: readSeq, writeSeq: writeSeq}}
+}
+
+// NewPing builds a connection-level Ping frame carrying token.
+func NewPing(token uint32) *Frame {
+	return &Frame{kind: frameTypePing, payload: &PingFrame{token: token}}
+}
+
+// NewPong builds a connection-level Pong frame echoing token.
+func NewPong(token uint32) *Frame {
+	return &Frame{kind: frameTypePong, payload: &PongFrame{token: token}}
+}
+
+// Write serialises f's header and payload (everything except a DataFrame's
+// actual bytes, which the caller writes separately) to w.
+func (f *Frame) Write(w io.Writer) error {
+	var header [5]byte
+	header[0] = byte(f.kind)
+	binary.BigEndian.PutUint32(header[1:], f.ID)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	switch p := f.payload.(type) {
+	case *OpenFrame:
+		if _, err := w.Write([]byte{byte(p.Connection)}); err != nil {
+			return err
+		}
+		return p.Destination.Write(w)
+	case *CloseFrame, *ShutdownFrame:
+		return nil
+	case *DataFrame:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], p.payloadlen)
+		_, err := w.Write(buf[:])
+		return err
+	case *WindowFrame:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], p.seq)
+		_, err := w.Write(buf[:])
+		return err
+	case *PingFrame:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], p.token)
+		_, err := w.Write(buf[:])
+		return err
+	case *PongFrame:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], p.token)
+		_, err := w.Write(buf[:])
+		return err
+	case *ResetFrame:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], p.code)
+		_, err := w.Write(buf[:])
+		return err
+	case *ResumeFrame:
+		var buf [16]byte
+		binary.BigEndian.PutUint64(buf[0:8], p.readSeq)
+		binary.BigEndian.PutUint64(buf[8:16], p.writeSeq)
+		_, err := w.Write(buf[:])
+		return err
+	default:
+		return fmt.Errorf("unknown frame payload type %T", f.payload)
+	}
+}
+
+// unmarshalFrame reads one Frame's header and payload fields from r. For a
+// Data frame, the payload bytes themselves are left for the caller to read,
+// using the returned DataFrame's payloadlen.
+func unmarshalFrame(r io.Reader) (*Frame, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	kind := frameType(header[0])
+	f := &Frame{ID: binary.BigEndian.Uint32(header[1:]), kind: kind}
+	switch kind {
+	case frameTypeOpen:
+		var connByte [1]byte
+		if _, err := io.ReadFull(r, connByte[:]); err != nil {
+			return nil, err
+		}
+		d, err := unmarshalDestination(r)
+		if err != nil {
+			return nil, err
+		}
+		f.payload = &OpenFrame{Connection: ConnectionType(connByte[0]), Destination: d}
+	case frameTypeClose:
+		f.payload = &CloseFrame{}
+	case frameTypeShutdown:
+		f.payload = &ShutdownFrame{}
+	case frameTypeData:
+		var buf [4]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		f.payload = &DataFrame{payloadlen: binary.BigEndian.Uint32(buf[:])}
+	case frameTypeWindow:
+		var buf [8]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		f.payload = &WindowFrame{seq: binary.BigEndian.Uint64(buf[:])}
+	case frameTypePing:
+		var buf [4]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		f.payload = &PingFrame{token: binary.BigEndian.Uint32(buf[:])}
+	case frameTypePong:
+		var buf [4]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		f.payload = &PongFrame{token: binary.BigEndian.Uint32(buf[:])}
+	case frameTypeReset:
+		var buf [4]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		f.payload = &ResetFrame{code: binary.BigEndian.Uint32(buf[:])}
+	case frameTypeResume:
+		var buf [16]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		f.payload = &ResumeFrame{
+			readSeq:  binary.BigEndian.Uint64(buf[0:8]),
+			writeSeq: binary.BigEndian.Uint64(buf[8:16]),
+		}
+	default:
+		return nil, fmt.Errorf("unknown frame type %d", kind)
+	}
+	return f, nil
+}
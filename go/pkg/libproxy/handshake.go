@@ -0,0 +1,47 @@
+package libproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// handshakeMagic identifies a libproxy multiplexer handshake on the wire.
+const handshakeMagic = "VPNKIT_MUX"
+
+// handshake is exchanged once, in both directions, before either side starts
+// the main multiplexer loop. Features is a bitmap of optional protocol
+// extensions (see the feature* constants) that the sender supports; a
+// feature is only enabled once both peers have advertised it, so an older
+// peer that sends a zero bitmap is never surprised by a feature it doesn't
+// know about.
+type handshake struct {
+	Features uint32
+}
+
+// Write sends h to w.
+func (h *handshake) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, handshakeMagic); err != nil {
+		return fmt.Errorf("writing handshake magic: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, h.Features); err != nil {
+		return fmt.Errorf("writing handshake features: %w", err)
+	}
+	return nil
+}
+
+// unmarshalHandshake reads a handshake previously written by Write.
+func unmarshalHandshake(r io.Reader) (*handshake, error) {
+	magic := make([]byte, len(handshakeMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("reading handshake magic: %w", err)
+	}
+	if string(magic) != handshakeMagic {
+		return nil, fmt.Errorf("unrecognised handshake magic %q", magic)
+	}
+	h := &handshake{}
+	if err := binary.Read(r, binary.LittleEndian, &h.Features); err != nil {
+		return nil, fmt.Errorf("reading handshake features: %w", err)
+	}
+	return h, nil
+}
@@ -4,18 +4,69 @@ import (
 	"bufio"
 	"bytes"
 	"container/ring"
+	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/zeebo/xxh3"
 	"golang.org/x/sync/errgroup"
 )
 
+// Handshake feature bits exchanged during NewMultiplexer's handshake. A
+// feature is only enabled once both peers advertise it, so a newer peer
+// stays wire-compatible with an older one that advertises none.
+const (
+	featureChecksums uint32 = 1 << iota
+)
+
+// slowReaderEvictions counts channels reset by multiplexer.run because their
+// consumer didn't keep up with ReceiveTimeout. Exposed for operators tuning
+// the timeout.
+var slowReaderEvictions = expvar.NewInt("libproxy_slow_reader_evictions")
+
+// errSlowReader is returned internally by multiplexer.writeToChannel when a
+// DataFrame payload couldn't be delivered to a channel's readPipe within
+// ReceiveTimeout.
+var errSlowReader = errors.New("slow reader: receive timeout exceeded")
+
 const defaultWindowSize = 65536
 
+// payloadBufferPool recycles the byte slices multiplexer.run reads DataFrame
+// payloads into, sized to the default negotiated window so the common case
+// needs no allocation. A payload larger than that (a channel with a bigger
+// SetReadBuffer) just allocates directly instead of growing pooled buffers.
+var payloadBufferPool = sync.Pool{
+	New: func() interface{} { return make([]byte, defaultWindowSize) },
+}
+
+func getPayloadBuffer(n int) []byte {
+	buf := payloadBufferPool.Get().([]byte)
+	if cap(buf) < n {
+		// Too small for this payload: give the pooled buffer back unused
+		// and allocate directly, rather than growing it - a grown buffer
+		// would be lost to the pool anyway, since putPayloadBuffer below
+		// only takes back buffers of exactly defaultWindowSize.
+		payloadBufferPool.Put(buf)
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+func putPayloadBuffer(buf []byte) {
+	if cap(buf) != defaultWindowSize {
+		// Not one of our pooled buffers (see getPayloadBuffer) - drop it
+		// instead of seeding the pool with an oversized slice.
+		return
+	}
+	payloadBufferPool.Put(buf[:cap(buf)])
+}
+
 type windowState struct {
 	current uint64
 	allowed uint64
@@ -39,21 +90,79 @@ func (w *windowState) advance() {
 }
 
 type channel struct {
-	m             sync.Mutex
-	c             *sync.Cond
-	multiplexer   *multiplexer
-	destination   Destination
-	ID            uint32
-	read          *windowState
-	write         *windowState
-	readPipe      *bufferedPipe
-	closeReceived bool
-	closeSent     bool
+	m sync.Mutex
+	c *sync.Cond
+	// multiplexerPtr is the channel's owning multiplexer, read and written
+	// through mux()/setMux() rather than as a plain field: a
+	// ReconnectingMultiplexer re-homes a channel onto a newly dialed
+	// multiplexer (reconnecting_multiplexer.go's reconnect) concurrently
+	// with application goroutines calling Write/Close/Reset, which read it
+	// without holding c.m - deliberately, so the I/O call isn't made under
+	// the lock (see Write below).
+	multiplexerPtr atomic.Pointer[multiplexer]
+	destination    Destination
+	ID             uint32
+	read           *windowState
+	write          *windowState
+	readPipe       *bufferedPipe
+	closeReceived  bool
+	closeSent      bool
 	// initially 2 (sender + receiver), protected by the multiplexer
 	refCount                     int
 	shutdownSent                 bool
+	resetSent                    bool
+	writeErr                     error
 	writeDeadline                time.Time
 	testAllowDataAfterCloseWrite bool
+
+	// resend retains bytes sent on this channel so a ReconnectingMultiplexer
+	// can replay anything the peer didn't get before a reconnect. Nil unless
+	// the owning multiplexer was built with ResendBufferSize > 0.
+	resend *resendBuffer
+
+	// recvSeq counts bytes received off the wire for this channel, i.e. as
+	// multiplexer.run hands DataFrame payloads to readPipe - unlike
+	// read.current, which only advances once the application actually calls
+	// Read/ReadBuffers. A ReconnectingMultiplexer reports recvSeq, not
+	// read.current, as this side's readSeq in a ResumeFrame: bytes already
+	// delivered into readPipe but not yet drained by the app when the
+	// connection drops must not be replayed by the peer after reconnect, or
+	// they'd be duplicated in the stream.
+	recvSeq uint64
+}
+
+// Reset codes carried by ResetFrame. ResetCodeNormal is used whenever the
+// caller doesn't have a more specific reason to give, e.g. RPC cancellation.
+const (
+	ResetCodeNormal uint32 = iota
+	// ResetCodeSlowReader is used when multiplexer.run evicts a channel
+	// whose consumer didn't call Read within ReceiveTimeout.
+	ResetCodeSlowReader
+	// ResetCodeResendOverflow is used when a ReconnectingMultiplexer can no
+	// longer retransmit the bytes a peer is missing after a reconnect,
+	// because they've already fallen out of the channel's resend buffer.
+	ResetCodeResendOverflow
+)
+
+// ResetError is returned from Read and Write once a channel has been reset,
+// either locally or by the peer, instead of io.EOF. Code identifies why, see
+// the ResetCode* constants.
+type ResetError struct {
+	Code uint32
+}
+
+func (e *ResetError) Error() string {
+	return fmt.Sprintf("channel reset, code %d", e.Code)
+}
+
+// resetCode extracts the code to put on the wire for err, defaulting to
+// ResetCodeNormal when err isn't already a *ResetError.
+func resetCode(err error) uint32 {
+	var resetErr *ResetError
+	if errors.As(err, &resetErr) {
+		return resetErr.Code
+	}
+	return ResetCodeNormal
 }
 
 func (c *channel) String() string {
@@ -76,9 +185,13 @@ func (c *channel) String() string {
 
 // newChannel registers a channel through the multiplexer
 func newChannel(multiplexer *multiplexer, ID uint32, d Destination) *channel {
-	readPipe := newBufferedPipe()
+	// Bound readPipe to the default window size. A peer that respects the
+	// window never has more than read.max bytes unread, so with the default
+	// window WriteBuffer doesn't block here; it blocks, and writeToChannel's
+	// ReceiveTimeout eviction can fire, only once SetReadBuffer has raised
+	// the window above this bound or the peer sends past its window.
+	readPipe := newBufferedPipe(defaultWindowSize)
 	c := &channel{
-		multiplexer: multiplexer,
 		destination: d,
 		ID:          ID,
 		read: &windowState{
@@ -90,16 +203,41 @@ func newChannel(multiplexer *multiplexer, ID uint32, d Destination) *channel {
 		readPipe: readPipe,
 		refCount: 2,
 	}
+	c.multiplexerPtr.Store(multiplexer)
+	if multiplexer.resendBufferSize > 0 {
+		c.resend = newResendBuffer(multiplexer.resendBufferSize)
+	}
 	c.c = sync.NewCond(&c.m)
 	return c
 }
 
+// mux returns the channel's current owning multiplexer. Safe to call
+// without holding c.m, including concurrently with setMux.
+func (c *channel) mux() *multiplexer {
+	return c.multiplexerPtr.Load()
+}
+
+// setMux re-homes the channel onto a new owning multiplexer, e.g. when a
+// ReconnectingMultiplexer redials. Safe to call concurrently with mux().
+func (c *channel) setMux(m *multiplexer) {
+	c.multiplexerPtr.Store(m)
+}
+
 func (c *channel) sendWindowUpdate() error {
 	c.m.Lock()
 	c.read.advance()
 	seq := c.read.allowed
 	c.m.Unlock()
-	return c.multiplexer.send(NewWindow(c.ID, seq), nil)
+	return c.mux().send(NewWindow(c.ID, seq), nil)
+}
+
+// recvData records n bytes of DataFrame payload received off the wire, for
+// recvSeq - called by multiplexer.run as soon as it reads a payload,
+// regardless of whether the application has drained it from readPipe yet.
+func (c *channel) recvData(n int) {
+	c.m.Lock()
+	c.recvSeq += uint64(n)
+	c.m.Unlock()
 }
 
 func (c *channel) recvWindowUpdate(seq uint64) {
@@ -123,6 +261,22 @@ func (c *channel) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// ReadBuffers fills bufs in order from readPipe in one call, the way Read
+// fills a single slice. Bytes are copied out of the pooled buffers the
+// receive loop filled exactly as Read copies them; the pooled buffers
+// themselves are not handed to the caller.
+func (c *channel) ReadBuffers(bufs net.Buffers) (int, error) {
+	n, err := c.readPipe.ReadBuffers(bufs)
+	c.m.Lock()
+	c.read.current = c.read.current + uint64(n)
+	needUpdate := c.read.isAlmostClosed()
+	c.m.Unlock()
+	if needUpdate {
+		c.sendWindowUpdate()
+	}
+	return n, err
+}
+
 // for unit testing only
 func (c *channel) setTestAllowDataAfterCloseWrite() {
 	c.testAllowDataAfterCloseWrite = true
@@ -137,6 +291,9 @@ func (c *channel) Write(p []byte) (int, error) {
 			return written, nil
 		}
 		if c.closeReceived || c.closeSent || (c.shutdownSent && !c.testAllowDataAfterCloseWrite) {
+			if c.writeErr != nil {
+				return written, c.writeErr
+			}
 			return written, io.EOF
 		}
 		if c.write.size() > 0 {
@@ -150,12 +307,15 @@ func (c *channel) Write(p []byte) (int, error) {
 
 			// Don't block holding the metadata mutex.
 			c.m.Unlock()
-			err := c.multiplexer.send(NewData(c.ID, uint32(toWrite)), p[0:toWrite])
+			err := c.mux().send(NewData(c.ID, uint32(toWrite)), p[0:toWrite])
 			c.m.Lock()
 
 			if err != nil {
 				return written, err
 			}
+			if c.resend != nil {
+				c.resend.append(p[0:toWrite])
+			}
 			p = p[toWrite:]
 			written = written + toWrite
 			continue
@@ -198,18 +358,109 @@ func (c *channel) Close() error {
 	if alreadyClosed {
 		return nil
 	}
-	if err := c.multiplexer.send(NewClose(c.ID), nil); err != nil {
+	if err := c.mux().send(NewClose(c.ID), nil); err != nil {
 		return err
 	}
 	c.m.Lock()
 	defer c.m.Unlock()
 	c.c.Broadcast()
 
-	c.multiplexer.decrChannelRef(c.ID)
+	c.mux().decrChannelRef(c.ID)
 
 	return nil
 }
 
+// Reset forcefully aborts the channel instead of draining it like
+// CloseWrite/Close do: any data queued for output is discarded, Writes
+// blocked on window space are unblocked with err, and both this side's and
+// the peer's pending Reads, and future Reads once anything already buffered
+// has been drained, fail with err (wrapped as *ResetError) rather than
+// io.EOF. This is the equivalent of mplex's
+// resetTag / yamux's RST, used e.g. to cancel an RPC without waiting for
+// buffered bytes to be delivered.
+func (c *channel) Reset(err error) error {
+	code := resetCode(err)
+	resetErr := &ResetError{Code: code}
+
+	// Unblock our own pending/future Read the same way recvReset does for
+	// the peer's: otherwise a reset triggered because the local consumer
+	// isn't draining Read would leave that consumer stuck forever.
+	c.readPipe.closeWriteError(resetErr)
+
+	c.m.Lock()
+	alreadyReset := c.resetSent || c.closeSent
+	c.resetSent = true
+	// Also mark closeSent so that Write returns resetErr instead of waiting
+	// for window space or sending more data, and CloseWrite/Close send nothing.
+	c.closeSent = true
+	c.writeErr = resetErr
+	c.m.Unlock()
+
+	if alreadyReset {
+		return nil
+	}
+	if sendErr := c.mux().send(NewReset(c.ID, code), nil); sendErr != nil {
+		return sendErr
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	// Unblock any Write that's waiting for window space.
+	c.c.Broadcast()
+
+	c.mux().decrChannelRef(c.ID)
+	return nil
+}
+
+// recvReset is invoked by multiplexer.run when a ResetFrame arrives for this
+// channel: it causes pending Reads, and future Reads once anything already
+// buffered for Read has been drained, to fail with a *ResetError carrying
+// code, and future Writes to fail the same way rather than blocking forever.
+func (c *channel) recvReset(code uint32) {
+	err := &ResetError{Code: code}
+	c.readPipe.closeWriteError(err)
+	c.m.Lock()
+	c.closeReceived = true
+	c.writeErr = err
+	c.c.Broadcast()
+	c.m.Unlock()
+}
+
+// recvResume handles a ResumeFrame from the peer after a reconnect. It
+// drops the bytes the peer confirms receiving (peerReadSeq) from this
+// channel's resend buffer, then replays whatever is left over the wire. If
+// the peer needs bytes this channel has already discarded, the channel is
+// reset rather than left silently desynchronised.
+//
+// peerWriteSeq is the number of bytes the peer has sent us; the peer's own
+// replay, driven by the readSeq we report in our own ResumeFrame, is what
+// recovers any gap where peerWriteSeq is ahead of what we've received - not
+// something this side needs to act on here. But peerWriteSeq behind what
+// we've already received (recvSeq) can't be explained by a replay still in
+// flight; it means the two sides disagree about what's been sent, so the
+// channel is reset rather than risk silently reading past a gap.
+func (c *channel) recvResume(peerReadSeq, peerWriteSeq uint64) {
+	c.m.Lock()
+	recvSeq := c.recvSeq
+	c.m.Unlock()
+	if peerWriteSeq < recvSeq {
+		_ = c.Reset(&ResetError{Code: ResetCodeResendOverflow})
+		return
+	}
+
+	if c.resend == nil {
+		return
+	}
+	c.resend.ack(peerReadSeq)
+	replay, ok := c.resend.since(peerReadSeq)
+	if !ok {
+		_ = c.Reset(&ResetError{Code: ResetCodeResendOverflow})
+		return
+	}
+	if len(replay) > 0 {
+		_ = c.mux().send(NewData(c.ID, uint32(len(replay))), replay)
+	}
+}
+
 func (c *channel) CloseRead() error {
 	return c.readPipe.CloseWrite()
 }
@@ -225,7 +476,7 @@ func (c *channel) CloseWrite() error {
 	if alreadyShutdown {
 		return nil
 	}
-	if err := c.multiplexer.send(NewShutdown(c.ID), nil); err != nil {
+	if err := c.mux().send(NewShutdown(c.ID), nil); err != nil {
 		return err
 	}
 	c.m.Lock()
@@ -339,6 +590,11 @@ type MultiplexedConn interface {
 	Conn
 	SetReadBuffer(uint) error  // SetReadBuffer sets the maximum read buffer size
 	SetWriteBuffer(uint) error // SetWriteBuffer sets the maximum write buffer size
+
+	// ReadBuffers fills a scatter/gather net.Buffers in one call instead of
+	// one Read per buffer. Bytes are copied into bufs just as Read copies
+	// them; the channel's pooled receive buffers are not handed out.
+	ReadBuffers(bufs net.Buffers) (int, error)
 }
 
 type multiplexer struct {
@@ -356,23 +612,92 @@ type multiplexer struct {
 	events            *ring.Ring // log of packetEvents
 	eventsM           sync.Mutex
 	allocateBackwards bool
+
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+	pingMutex         sync.Mutex
+	nextPingToken     uint32
+	pingOutstanding   bool
+	pingToken         uint32
+	pingAcked         bool
+
+	receiveTimeout      time.Duration
+	onSlowReaderEvicted func(id uint32, d Destination)
+
+	resendBufferSize int
+
+	// checksumsEnabled is true when both peers advertised featureChecksums
+	// during the handshake, in which case every frame is followed by an
+	// xxh3-64 trailer that send/run compute and verify.
+	checksumsEnabled bool
+
+	// done is closed once by teardown when the receive loop exits, letting
+	// a ReconnectingMultiplexer wait for failure without polling.
+	done chan struct{}
+
+	// teardownOnce guards teardown's body: a keepalive timeout and run()
+	// returning (e.g. because teardown closing conn below unblocked its
+	// read) can both reach teardown concurrently, and running it twice
+	// would double-close done and panic.
+	teardownOnce sync.Once
+
+	// resumable is set by a ReconnectingMultiplexer on the multiplexers it
+	// builds, so teardown leaves still-open channels alone instead of
+	// closing them out from under it - it intends to re-home them onto a
+	// freshly dialed multiplexer and resume them there.
+	resumable bool
+}
+
+// MultiplexerConfig carries optional tunables for NewMultiplexerConfig.
+type MultiplexerConfig struct {
+	// KeepAliveInterval is the time between Pings sent to the peer to detect
+	// a connection which has gone silently dead. Zero disables keepalives.
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout is how long to wait for a Pong before treating the
+	// peer as dead and tearing down the multiplexer. Only meaningful when
+	// KeepAliveInterval is non-zero.
+	KeepAliveTimeout time.Duration
+	// ReceiveTimeout bounds how long multiplexer.run will wait to hand a
+	// DataFrame's payload to a channel's reader. A channel that doesn't
+	// drain within this time is assumed to have a stuck consumer and is
+	// Reset (ResetCodeSlowReader) instead of stalling the demux loop for
+	// every other channel. Zero disables the timeout.
+	ReceiveTimeout time.Duration
+	// OnSlowReaderEvicted, if set, is called whenever ReceiveTimeout causes
+	// a channel to be evicted, so operators can observe and tune it.
+	OnSlowReaderEvicted func(id uint32, d Destination)
+	// ResendBufferSize bounds, per channel, how many recently-sent but not
+	// yet peer-acknowledged bytes are retained so a ReconnectingMultiplexer
+	// can replay them after a reconnect. Zero disables resend support,
+	// which is the right choice unless this multiplexer runs under a
+	// ReconnectingMultiplexer.
+	ResendBufferSize int
 }
 
 // NewMultiplexer constructs a multiplexer from a channel
 func NewMultiplexer(label string, conn io.ReadWriteCloser, allocateBackwards bool) (Multiplexer, error) {
+	return NewMultiplexerConfig(label, conn, allocateBackwards, MultiplexerConfig{})
+}
+
+// NewMultiplexerConfig constructs a multiplexer from a channel, with the
+// additional tunables described by config. See MultiplexerConfig.
+func NewMultiplexerConfig(label string, conn io.ReadWriteCloser, allocateBackwards bool, config MultiplexerConfig) (Multiplexer, error) {
 	channels := make(map[uint32]*channel)
 	connR := bufio.NewReader(conn)
 	connW := bufio.NewWriter(conn)
 	events := ring.New(500)
 
-	// Perform the handshake
-	localH := &handshake{}
+	// Perform the handshake, advertising every feature we support. A feature
+	// is only enabled below once the remote side has advertised it too.
+	localH := &handshake{Features: featureChecksums}
 
 	g := &errgroup.Group{}
 
+	var remoteH *handshake
 	g.Go(func() error { return localH.Write(conn) })
 	g.Go(func() error {
-		_, err := unmarshalHandshake(connR)
+		h, err := unmarshalHandshake(connR)
+		remoteH = h
 		return err
 	})
 
@@ -385,14 +710,21 @@ func NewMultiplexer(label string, conn io.ReadWriteCloser, allocateBackwards boo
 		nextId = ^nextId
 	}
 	m := &multiplexer{
-		label:             label,
-		conn:              conn,
-		connR:             connR,
-		connW:             connW,
-		channels:          channels,
-		nextChannelID:     nextId,
-		events:            events,
-		allocateBackwards: allocateBackwards,
+		label:               label,
+		conn:                conn,
+		connR:               connR,
+		connW:               connW,
+		channels:            channels,
+		nextChannelID:       nextId,
+		events:              events,
+		allocateBackwards:   allocateBackwards,
+		keepAliveInterval:   config.KeepAliveInterval,
+		keepAliveTimeout:    config.KeepAliveTimeout,
+		receiveTimeout:      config.ReceiveTimeout,
+		onSlowReaderEvicted: config.OnSlowReaderEvicted,
+		resendBufferSize:    config.ResendBufferSize,
+		checksumsEnabled:    remoteH.Features&featureChecksums != 0,
+		done:                make(chan struct{}),
 	}
 	m.acceptCond = sync.NewCond(&m.metadataMutex)
 	return m, nil
@@ -419,12 +751,29 @@ func (m *multiplexer) send(f *Frame, payload []byte) error {
 	defer m.writeMutex.Unlock()
 	m.appendEvent(&event{eventType: eventSend, frame: f})
 
-	if err := f.Write(m.connW); err != nil {
+	// Buffer the header rather than writing it straight to connW so that,
+	// when checksums are enabled, we can hash exactly the header+payload
+	// bytes that go on the wire for this frame.
+	var header bytes.Buffer
+	if err := f.Write(&header); err != nil {
+		return fmt.Errorf("writing frame %s: %w", f, err)
+	}
+	if _, err := m.connW.Write(header.Bytes()); err != nil {
 		return fmt.Errorf("writing frame %s: %w", f, err)
 	}
 	if n, err := m.connW.Write(payload); err != nil || n != len(payload) {
 		return fmt.Errorf("writing frame %s payload length %d: %d, %w", f, len(payload), n, err)
 	}
+	if m.checksumsEnabled {
+		sum := xxh3.New()
+		sum.Write(header.Bytes())
+		sum.Write(payload)
+		var trailer [8]byte
+		binary.LittleEndian.PutUint64(trailer[:], sum.Sum64())
+		if _, err := m.connW.Write(trailer[:]); err != nil {
+			return fmt.Errorf("writing frame %s checksum: %w", f, err)
+		}
+	}
 	if err := m.connW.Flush(); err != nil {
 		return fmt.Errorf("flushing frame %s: %w", f, err)
 	}
@@ -493,6 +842,10 @@ func (m *multiplexer) Dial(d Destination) (MultiplexedConn, error) {
 
 var ErrNotRunning = errors.New("multiplexer is not running")
 
+// ErrKeepAliveTimeout is the failure reason recorded when keepalives are
+// enabled and the peer does not Pong back before KeepAliveTimeout elapses.
+var ErrKeepAliveTimeout = errors.New("keepalive: timed out waiting for a pong from the peer")
+
 // Accept returns the next client connection
 func (m *multiplexer) Accept() (MultiplexedConn, *Destination, error) {
 	first, err := m.nextPendingAccept()
@@ -529,37 +882,126 @@ func (m *multiplexer) Run() {
 	m.metadataMutex.Lock()
 	m.isRunning = true
 	m.metadataMutex.Unlock()
+	if m.keepAliveInterval > 0 {
+		go m.keepAliveLoop()
+	}
 	go func() {
 		err := m.run()
-		m.metadataMutex.Lock()
-		expected := err == io.EOF || !m.isRunning
-		m.metadataMutex.Unlock()
-		if expected {
-			// This is expected when the data connection is broken
-			log.Infof("disconnected data connection: multiplexer is offline")
-		} else if err != nil {
-			log.Printf("Multiplexer main loop failed with %v", err)
-			m.DumpState(log.Writer())
-		}
-		m.metadataMutex.Lock()
-		m.isRunning = false
-		m.acceptCond.Broadcast()
-		var channels []*channel
+		m.teardown(err)
+	}()
+}
+
+// teardown shuts down every channel and marks the multiplexer as no longer
+// running. It is called when the main receive loop exits, e.g. on a read
+// error, and by keepAliveLoop when a ping goes unanswered; only the first
+// call has any effect.
+func (m *multiplexer) teardown(err error) {
+	m.teardownOnce.Do(func() { m.teardownLocked(err) })
+}
+
+func (m *multiplexer) teardownLocked(err error) {
+	m.metadataMutex.Lock()
+	expected := err == io.EOF || !m.isRunning
+	m.metadataMutex.Unlock()
+	if expected {
+		// This is expected when the data connection is broken
+		log.Infof("disconnected data connection: multiplexer is offline")
+	} else if err != nil {
+		log.Printf("Multiplexer main loop failed with %v", err)
+		m.DumpState(log.Writer())
+	}
+
+	// Close the underlying connection so that, in particular, a keepalive
+	// timeout actually unblocks the run() goroutine's in-flight read
+	// instead of leaking it (and the socket) forever.
+	m.conn.Close()
+
+	m.metadataMutex.Lock()
+	m.isRunning = false
+	m.acceptCond.Broadcast()
+	var channels []*channel
+	// A ReconnectingMultiplexer marks its multiplexers resumable and wants
+	// to re-home their still-open channels onto a freshly dialed connection
+	// rather than have them torn down here out from under it.
+	if !m.resumable {
 		for _, channel := range m.channels {
 			channels = append(channels, channel)
 		}
-		m.metadataMutex.Unlock()
+	}
+	m.metadataMutex.Unlock()
 
-		// close all open channels
-		for _, channel := range channels {
-			// this will unblock waiting Read calls
-			channel.readPipe.closeWriteNoErr()
-			// this will unblock waiting Write calls
-			channel.recvClose()
-			m.decrChannelRef(channel.ID)
+	// close all open channels
+	for _, channel := range channels {
+		// this will unblock waiting Read calls
+		channel.readPipe.closeWriteNoErr()
+		// this will unblock waiting Write calls
+		channel.recvClose()
+		m.decrChannelRef(channel.ID)
+	}
+	close(m.done)
+}
+
+// keepAliveLoop periodically sends a Ping to the peer and tears the
+// multiplexer down, like a read error would, if the matching Pong doesn't
+// arrive within KeepAliveTimeout. This catches a peer that has gone away
+// without closing the underlying connection, e.g. a NAT-dropped or
+// half-open TCP session.
+func (m *multiplexer) keepAliveLoop() {
+	ticker := time.NewTicker(m.keepAliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !m.IsRunning() {
+			return
+		}
+		if err := m.sendPing(); err != nil {
+			return
+		}
+		if m.keepAliveTimeout <= 0 {
+			continue
 		}
+		// Check for the Pong on its own timer instead of blocking here:
+		// sleeping through keepAliveTimeout on every tick would stretch the
+		// actual ping cadence to keepAliveInterval+keepAliveTimeout instead
+		// of the configured keepAliveInterval, since the next tick couldn't
+		// be processed until this one's timeout had fully elapsed.
+		time.AfterFunc(m.keepAliveTimeout, func() {
+			if m.pingTimedOut() {
+				m.teardown(ErrKeepAliveTimeout)
+			}
+		})
+	}
+}
 
-	}()
+// sendPing sends a Ping carrying a fresh, monotonically increasing token and
+// records it as the outstanding ping to match against the next Pong.
+func (m *multiplexer) sendPing() error {
+	m.pingMutex.Lock()
+	token := m.nextPingToken
+	m.nextPingToken++
+	m.pingToken = token
+	m.pingOutstanding = true
+	m.pingAcked = false
+	m.pingMutex.Unlock()
+	return m.send(NewPing(token), nil)
+}
+
+// pingTimedOut reports whether the current outstanding ping was never
+// acked, and clears the outstanding flag either way.
+func (m *multiplexer) pingTimedOut() bool {
+	m.pingMutex.Lock()
+	defer m.pingMutex.Unlock()
+	timedOut := m.pingOutstanding && !m.pingAcked
+	m.pingOutstanding = false
+	return timedOut
+}
+
+// recvPong matches an incoming Pong's token against the outstanding ping.
+func (m *multiplexer) recvPong(token uint32) {
+	m.pingMutex.Lock()
+	defer m.pingMutex.Unlock()
+	if m.pingOutstanding && token == m.pingToken {
+		m.pingAcked = true
+	}
 }
 
 // DumpState writes internal multiplexer state
@@ -596,9 +1038,103 @@ func (m *multiplexer) IsRunning() bool {
 	return m.isRunning
 }
 
+// writeToChannel hands a DataFrame's payload to c's readPipe as a pooled
+// buffer plus a release callback, so channel.Read can copy bytes out as the
+// application consumes them and return the buffer to payloadBufferPool
+// instead of multiplexer.run allocating and copying it up front. The wait is
+// bounded by receiveTimeout so that one channel whose consumer has stopped
+// calling Read cannot stall the demux loop for every other channel; on
+// timeout this returns errSlowReader, and release is still called once the
+// backgrounded write eventually completes.
+func (m *multiplexer) writeToChannel(c *channel, buf []byte, release func()) error {
+	if m.receiveTimeout <= 0 {
+		return c.readPipe.WriteBuffer(buf, release)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.readPipe.WriteBuffer(buf, release)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(m.receiveTimeout):
+		return errSlowReader
+	}
+}
+
+// evictSlowReader resets a channel whose consumer didn't drain a DataFrame
+// within receiveTimeout, dropping the offending payload and reporting the
+// eviction rather than letting it block the shared demux loop.
+func (m *multiplexer) evictSlowReader(c *channel) {
+	log.Printf("Evicting slow reader on channel %s: no Read within %s", c.String(), m.receiveTimeout)
+	slowReaderEvictions.Add(1)
+	if m.onSlowReaderEvicted != nil {
+		m.onSlowReaderEvicted(c.ID, c.destination)
+	}
+	_ = c.Reset(&ResetError{Code: ResetCodeSlowReader})
+}
+
+// checksumReader wraps the multiplexer's connR, mirroring every byte read
+// through it into a buffer that reset() drains, so the bytes making up one
+// frame can be hashed and checked against the trailer sent after it.
+type checksumReader struct {
+	io.Reader
+	buf bytes.Buffer
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	cr := &checksumReader{}
+	cr.Reader = io.TeeReader(r, &cr.buf)
+	return cr
+}
+
+func (cr *checksumReader) reset() []byte {
+	b := append([]byte(nil), cr.buf.Bytes()...)
+	cr.buf.Reset()
+	return b
+}
+
+// verifyChecksum reads the 8-byte xxh3-64 trailer following a frame and
+// confirms it matches the header+payload bytes captured by cr for that
+// frame since the last reset. A mismatch means the stream is
+// desynchronised, so the connection is dumped and torn down rather than
+// continuing to demux a corrupted stream.
+func (m *multiplexer) verifyChecksum(cr *checksumReader) error {
+	frame := cr.reset()
+	var trailer [8]byte
+	if _, err := io.ReadFull(m.connR, trailer[:]); err != nil {
+		return fmt.Errorf("reading frame checksum: %w", err)
+	}
+	got := binary.LittleEndian.Uint64(trailer[:])
+	want := xxh3.Hash(frame)
+	if got != want {
+		m.DumpState(log.Writer())
+		return fmt.Errorf("frame checksum mismatch (got %x, want %x): stream is desynchronised", got, want)
+	}
+	return nil
+}
+
 func (m *multiplexer) run() error {
+	var cr *checksumReader
+	frameReader := m.connR
+	if m.checksumsEnabled {
+		cr = newChecksumReader(m.connR)
+		frameReader = cr
+	}
+	first := true
 	for {
-		f, err := unmarshalFrame(m.connR)
+		// Verify the previous frame's checksum now, rather than right after
+		// it's processed, so it covers every byte consumed for that frame
+		// (e.g. a DataFrame's payload, read further down in the switch)
+		// regardless of which case handled it or whether that case
+		// continued the loop early.
+		if cr != nil && !first {
+			if err := m.verifyChecksum(cr); err != nil {
+				return err
+			}
+		}
+		first = false
+		f, err := unmarshalFrame(frameReader)
 		if err != nil {
 			return err
 		}
@@ -640,13 +1176,23 @@ func (m *multiplexer) run() error {
 			// EOF on Write, they will drop the data in the buffer and we don't know how big
 			// it was so we can't avoid desychronising the stream.
 			// We trust the clients not to write more than a Window size.
-			var buf bytes.Buffer
-			if _, err := io.CopyN(&buf, m.connR, int64(payload.payloadlen)); err != nil {
+			buf := getPayloadBuffer(int(payload.payloadlen))
+			if _, err := io.ReadFull(frameReader, buf); err != nil {
+				putPayloadBuffer(buf)
 				return fmt.Errorf("Failed to read payload of %d bytes: %s", payload.payloadlen, f.String())
 			}
-			if n, err := io.Copy(channel.readPipe, &buf); err != nil {
+			// Count buf as received now, not when the application eventually
+			// calls Read - a ResumeFrame sent after a reconnect must not ask
+			// the peer to replay bytes already sitting in readPipe.
+			channel.recvData(len(buf))
+			release := func() { putPayloadBuffer(buf) }
+			if err := m.writeToChannel(channel, buf, release); err != nil {
+				if err == errSlowReader {
+					m.evictSlowReader(channel)
+					continue
+				}
 				// err must be io.EOF
-				log.Printf("Discarded %d bytes from %s", int64(payload.payloadlen)-n, f.String())
+				log.Printf("Discarded %d bytes from %s", len(buf), f.String())
 				// A confused client could send a DataFrame after a ShutdownFrame or CloseFrame.
 				// The stream is not desychronised so we can keep going.
 			}
@@ -670,6 +1216,34 @@ func (m *multiplexer) run() error {
 			// this will unblock waiting Write calls
 			channel.recvClose()
 			m.decrChannelRef(channel.ID)
+		case *ResetFrame:
+			m.metadataMutex.Lock()
+			channel, ok := m.channels[f.ID]
+			m.metadataMutex.Unlock()
+			if !ok {
+				return fmt.Errorf("Unknown channel id: %s", f.String())
+			}
+			channel.recvReset(payload.code)
+			m.decrChannelRef(channel.ID)
+		case *ResumeFrame:
+			m.metadataMutex.Lock()
+			channel, ok := m.channels[f.ID]
+			m.metadataMutex.Unlock()
+			if !ok {
+				// The peer is resuming a channel we have no record of, e.g.
+				// because we restarted. Nothing to resume; ignore.
+				continue
+			}
+			channel.recvResume(payload.readSeq, payload.writeSeq)
+		case *PingFrame:
+			// Echo back any Ping we didn't solicit ourselves, so the peer's
+			// keepalive loop sees a Pong whether or not it has one of its
+			// own outstanding.
+			if err := m.send(NewPong(payload.token), nil); err != nil {
+				return err
+			}
+		case *PongFrame:
+			m.recvPong(payload.token)
 		default:
 			return fmt.Errorf("Unknown command type: %v", f)
 		}
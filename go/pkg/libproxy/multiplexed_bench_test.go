@@ -0,0 +1,103 @@
+package libproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// benchPacketSize is the payload size used by BenchmarkSmallPackets, matching
+// go-mplex's testSmallPackets: small enough that framing/locking overhead
+// dominates, which is the thing this benchmark is meant to catch regressions
+// in.
+const benchPacketSize = 64
+
+// newBenchMultiplexerPair wires up a client and server Multiplexer over an
+// in-memory net.Pipe, handshaking both ends concurrently (the handshake
+// blocks on an unbuffered pipe, so it can't be done sequentially).
+func newBenchMultiplexerPair(tb testing.TB) (client, server Multiplexer) {
+	tb.Helper()
+	clientConn, serverConn := net.Pipe()
+
+	type result struct {
+		m   Multiplexer
+		err error
+	}
+	clientCh := make(chan result, 1)
+	serverCh := make(chan result, 1)
+	go func() {
+		m, err := NewMultiplexer("bench-client", clientConn, false)
+		clientCh <- result{m, err}
+	}()
+	go func() {
+		m, err := NewMultiplexer("bench-server", serverConn, true)
+		serverCh <- result{m, err}
+	}()
+
+	clientRes, serverRes := <-clientCh, <-serverCh
+	if clientRes.err != nil {
+		tb.Fatalf("client handshake failed: %v", clientRes.err)
+	}
+	if serverRes.err != nil {
+		tb.Fatalf("server handshake failed: %v", serverRes.err)
+	}
+	clientRes.m.Run()
+	serverRes.m.Run()
+	return clientRes.m, serverRes.m
+}
+
+// BenchmarkSmallPackets is modeled on go-mplex's testSmallPackets: it opens
+// a single channel and round-trips many small packets over it, to gate
+// regressions in per-packet overhead (e.g. from locking or allocation added
+// around the send/receive path).
+func BenchmarkSmallPackets(b *testing.B) {
+	client, server := newBenchMultiplexerPair(b)
+	defer client.Close()
+	defer server.Close()
+
+	accepted := make(chan MultiplexedConn, 1)
+	go func() {
+		conn, _, err := server.Accept()
+		if err != nil {
+			b.Errorf("accept failed: %v", err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	clientConn, err := client.Dial(Destination{})
+	if err != nil {
+		b.Fatalf("dial failed: %v", err)
+	}
+	defer clientConn.Close()
+
+	serverConn := <-accepted
+	defer serverConn.Close()
+
+	go func() {
+		buf := make([]byte, benchPacketSize)
+		for {
+			n, err := serverConn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := serverConn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	out := make([]byte, benchPacketSize)
+	in := make([]byte, benchPacketSize)
+
+	b.SetBytes(benchPacketSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := clientConn.Write(out); err != nil {
+			b.Fatalf("write failed: %v", err)
+		}
+		if _, err := io.ReadFull(clientConn, in); err != nil {
+			b.Fatalf("read failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package libproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// ReconnectingMultiplexerConfig configures a ReconnectingMultiplexer.
+type ReconnectingMultiplexerConfig struct {
+	MultiplexerConfig
+	// ReconnectBackoff is how long to wait between failed Dial/handshake
+	// attempts while reconnecting. Defaults to one second.
+	ReconnectBackoff time.Duration
+}
+
+// ReconnectingMultiplexer wraps a Multiplexer built over a Transport and
+// transparently redials and resumes it after the underlying connection is
+// lost, instead of failing permanently like a plain Multiplexer does. This
+// is intended for transports such as WebSocketTransport that run over links
+// (browser-reachable endpoints, NAT-traversed relays) which are expected to
+// drop and come back.
+type ReconnectingMultiplexer struct {
+	label             string
+	transport         Transport
+	allocateBackwards bool
+	config            ReconnectingMultiplexerConfig
+	ctx               context.Context
+
+	m       sync.Mutex
+	current *multiplexer
+	closed  bool
+}
+
+// NewReconnectingMultiplexer dials transport, performs the initial
+// handshake, and returns a Multiplexer that keeps reconnecting through
+// transport instead of dying on the first read error. Call Run to start
+// processing frames and watching for disconnects.
+func NewReconnectingMultiplexer(ctx context.Context, label string, transport Transport, allocateBackwards bool, config ReconnectingMultiplexerConfig) (Multiplexer, error) {
+	r := &ReconnectingMultiplexer{
+		label:             label,
+		transport:         transport,
+		allocateBackwards: allocateBackwards,
+		config:            config,
+		ctx:               ctx,
+	}
+	m, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.current = m
+	return r, nil
+}
+
+func (r *ReconnectingMultiplexer) dial(ctx context.Context) (*multiplexer, error) {
+	conn, err := r.transport.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	built, err := NewMultiplexerConfig(r.label, conn, r.allocateBackwards, r.config.MultiplexerConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m := built.(*multiplexer)
+	// Tell teardown not to close out still-open channels if this connection
+	// fails: reconnect below re-homes them onto the next one instead, and a
+	// channel that's already been torn down (readPipe closed, recvClose'd)
+	// can't be resumed - its Read/Write would keep returning io.EOF
+	// regardless of any ResumeFrame sent afterwards.
+	m.resumable = true
+	return m, nil
+}
+
+// Run starts the wrapped multiplexer and a background loop which redials
+// and resumes whenever it stops running.
+func (r *ReconnectingMultiplexer) Run() {
+	r.m.Lock()
+	cur := r.current
+	r.m.Unlock()
+	cur.Run()
+	go r.monitor()
+}
+
+// IsRunning is true until Close is called, or until reconnecting gives up
+// (transport.Dial or the handshake keeps failing past the context deadline).
+func (r *ReconnectingMultiplexer) IsRunning() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return !r.closed
+}
+
+// Dial opens a connection to the given destination over the current
+// underlying multiplexer.
+func (r *ReconnectingMultiplexer) Dial(d Destination) (MultiplexedConn, error) {
+	r.m.Lock()
+	cur := r.current
+	r.m.Unlock()
+	return cur.Dial(d)
+}
+
+// Accept returns the next client connection from the current underlying
+// multiplexer. A caller should retry Accept after a reconnect if it returns
+// ErrNotRunning, rather than treating that as terminal.
+func (r *ReconnectingMultiplexer) Accept() (MultiplexedConn, *Destination, error) {
+	r.m.Lock()
+	cur := r.current
+	r.m.Unlock()
+	return cur.Accept()
+}
+
+// Close stops reconnecting and closes the current underlying transport.
+func (r *ReconnectingMultiplexer) Close() error {
+	r.m.Lock()
+	r.closed = true
+	cur := r.current
+	r.m.Unlock()
+	return cur.Close()
+}
+
+// DumpState dumps the current underlying multiplexer's debug state.
+func (r *ReconnectingMultiplexer) DumpState(w io.Writer) {
+	r.m.Lock()
+	cur := r.current
+	r.m.Unlock()
+	cur.DumpState(w)
+}
+
+// monitor waits for the current underlying multiplexer to stop running and
+// then reconnects, repeating until Close is called or reconnecting gives up.
+func (r *ReconnectingMultiplexer) monitor() {
+	for {
+		r.m.Lock()
+		cur := r.current
+		closed := r.closed
+		r.m.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case <-cur.done:
+		case <-r.ctx.Done():
+			return
+		}
+		r.m.Lock()
+		closed = r.closed
+		r.m.Unlock()
+		if closed {
+			return
+		}
+		if err := r.reconnect(cur); err != nil {
+			log.Printf("%s: giving up reconnecting: %v", r.label, err)
+			r.m.Lock()
+			r.closed = true
+			r.m.Unlock()
+			return
+		}
+	}
+}
+
+// reconnect redials the transport, carries every still-open channel from
+// failed over to the new underlying multiplexer under the same channel ID,
+// and sends each one a ResumeFrame so the peer can replay anything lost
+// during the disconnect.
+func (r *ReconnectingMultiplexer) reconnect(failed *multiplexer) error {
+	backoff := r.config.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	var newM *multiplexer
+	for {
+		m, err := r.dial(r.ctx)
+		if err == nil {
+			newM = m
+			break
+		}
+		log.Printf("%s: reconnect failed, retrying in %s: %v", r.label, backoff, err)
+		select {
+		case <-r.ctx.Done():
+			// Giving up for good: failed's channels were deliberately left
+			// open by teardown (resumable=true) expecting us to re-home
+			// them below. Since that's never going to happen now, close
+			// them out here instead, or every application goroutine
+			// blocked in Read/Write on one would otherwise hang forever.
+			r.abandonChannels(failed)
+			return r.ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+
+	failed.metadataMutex.Lock()
+	channels := make([]*channel, 0, len(failed.channels))
+	for _, c := range failed.channels {
+		channels = append(channels, c)
+	}
+	failed.metadataMutex.Unlock()
+
+	type resume struct {
+		id                uint32
+		readSeq, writeSeq uint64
+	}
+	resumes := make([]resume, 0, len(channels))
+
+	newM.metadataMutex.Lock()
+	for _, c := range channels {
+		c.setMux(newM)
+		c.m.Lock()
+		// readSeq must be recvSeq (bytes received off the wire), not
+		// read.current (bytes the application has actually drained via
+		// Read) - otherwise bytes already sitting in readPipe but not yet
+		// consumed when the connection dropped would look unreceived to the
+		// peer and get replayed, duplicating them in the stream.
+		readSeq := c.recvSeq
+		writeSeq := c.write.current
+		c.m.Unlock()
+		newM.channels[c.ID] = c
+		if r.allocateBackwards {
+			if c.ID <= newM.nextChannelID {
+				newM.nextChannelID = c.ID - 1
+			}
+		} else if c.ID >= newM.nextChannelID {
+			newM.nextChannelID = c.ID + 1
+		}
+		resumes = append(resumes, resume{c.ID, readSeq, writeSeq})
+	}
+	newM.metadataMutex.Unlock()
+
+	r.m.Lock()
+	r.current = newM
+	r.m.Unlock()
+
+	newM.Run()
+
+	for _, rs := range resumes {
+		if err := newM.send(NewResume(rs.id, rs.readSeq, rs.writeSeq), nil); err != nil {
+			log.Printf("%s: failed to send resume for channel %d: %v", r.label, rs.id, err)
+		}
+	}
+	return nil
+}
+
+// abandonChannels closes out failed's still-open channels instead of
+// re-homing them, for when reconnect is giving up for good: teardown left
+// them alone (resumable=true) on the assumption reconnect would either
+// carry them over to a new multiplexer or, failing that, close them out
+// itself.
+func (r *ReconnectingMultiplexer) abandonChannels(failed *multiplexer) {
+	failed.metadataMutex.Lock()
+	channels := make([]*channel, 0, len(failed.channels))
+	for _, c := range failed.channels {
+		channels = append(channels, c)
+	}
+	failed.metadataMutex.Unlock()
+
+	for _, c := range channels {
+		c.readPipe.closeWriteNoErr()
+		c.recvClose()
+		failed.decrChannelRef(c.ID)
+	}
+}
@@ -0,0 +1,78 @@
+package libproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Transport establishes the framed connection that a Multiplexer runs over.
+// NewMultiplexer takes a ready-made io.ReadWriteCloser directly; Transport
+// exists so a ReconnectingMultiplexer can obtain a fresh one after a
+// transient failure by calling Dial again.
+type Transport interface {
+	// Dial returns a new connection to the peer. It may be called more than
+	// once over the lifetime of a ReconnectingMultiplexer, once per
+	// (re)connect attempt.
+	Dial(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// resendBuffer retains the tail of a channel's sent-byte stream so a
+// ReconnectingMultiplexer can replay whatever the peer didn't get across a
+// reconnect. It is bounded: once full, the oldest not-yet-acked bytes are
+// discarded, and a replay request for a sequence number older than what's
+// retained fails rather than silently sending the wrong bytes.
+type resendBuffer struct {
+	m        sync.Mutex
+	base     uint64 // sequence number of buf[0]
+	buf      []byte
+	capacity int
+}
+
+func newResendBuffer(capacity int) *resendBuffer {
+	return &resendBuffer{capacity: capacity}
+}
+
+// append records bytes that were just sent on the wire.
+func (r *resendBuffer) append(p []byte) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.buf = append(r.buf, p...)
+	if over := len(r.buf) - r.capacity; over > 0 {
+		r.buf = r.buf[over:]
+		r.base += uint64(over)
+	}
+}
+
+// ack discards bytes before seq, once the peer has confirmed receiving them.
+func (r *resendBuffer) ack(seq uint64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if seq <= r.base {
+		return
+	}
+	drop := seq - r.base
+	if drop > uint64(len(r.buf)) {
+		drop = uint64(len(r.buf))
+	}
+	r.buf = r.buf[drop:]
+	r.base += drop
+}
+
+// since returns a copy of the bytes sent from seq onwards. ok is false if
+// seq is older than the oldest byte still retained, meaning the requested
+// bytes have already been evicted and can't be replayed.
+func (r *resendBuffer) since(seq uint64) (p []byte, ok bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if seq < r.base {
+		return nil, false
+	}
+	offset := seq - r.base
+	if offset > uint64(len(r.buf)) {
+		return nil, false
+	}
+	out := make([]byte, len(r.buf)-int(offset))
+	copy(out, r.buf[offset:])
+	return out, true
+}
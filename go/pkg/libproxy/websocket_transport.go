@@ -0,0 +1,89 @@
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketTransport dials a Multiplexer connection over WebSocket, framing
+// each write as one binary WS message. It's meant for deployments (Telebit
+// style relays, browser-reachable endpoints) where a raw TCP connection
+// isn't an option but WebSocket is, typically paired with a
+// ReconnectingMultiplexer so a dropped socket gets redialed automatically.
+type WebSocketTransport struct {
+	// URL is the ws:// or wss:// endpoint to dial.
+	URL string
+	// Header is sent with the WebSocket upgrade request, e.g. for auth.
+	Header http.Header
+	// Dialer overrides the websocket dialer used, e.g. for TLS config or a
+	// custom proxy. Defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+}
+
+// Dial implements Transport.
+func (t *WebSocketTransport) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	dialer := t.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, _, err := dialer.DialContext(ctx, t.URL, t.Header)
+	if err != nil {
+		return nil, fmt.Errorf("dialing websocket transport %s: %w", t.URL, err)
+	}
+	return &wsConn{conn: conn}, nil
+}
+
+// wsConn adapts a *websocket.Conn, which frames messages rather than
+// exposing a byte stream, to io.ReadWriteCloser. Each Write is sent as a
+// single binary message; Read transparently advances across message
+// boundaries so callers see one continuous stream, as multiplexer.send and
+// unmarshalFrame expect.
+type wsConn struct {
+	conn *websocket.Conn
+
+	writeMutex sync.Mutex
+
+	readMutex sync.Mutex
+	current   io.Reader
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	w.readMutex.Lock()
+	defer w.readMutex.Unlock()
+	for {
+		if w.current == nil {
+			_, r, err := w.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			w.current = r
+		}
+		n, err := w.current.Read(p)
+		if err == io.EOF {
+			w.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (w *wsConn) Write(p []byte) (int, error) {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsConn) Close() error {
+	return w.conn.Close()
+}